@@ -63,16 +63,32 @@ const (
 
 	defaultTxsCacheSize      = 20
 	defaultBroadcastInterval = 100 * time.Millisecond
+
+	// maxBlockHashAnnounces is the maximum number of block hashes accepted in a
+	// single announcement. Blocks are announced one by one, so anything above a
+	// small batch is a peer trying to flood us.
+	maxBlockHashAnnounces = 64
 )
 
 // errIncompatibleConfig is returned if the requested protocols and configs are
 // not compatible (low protocol version restrictions and high requirements).
 var errIncompatibleConfig = errors.New("incompatible configuration")
 
+// errPeerDisconnected is returned by background responders if the requesting
+// peer disconnected before the response was fully served.
+var errPeerDisconnected = errors.New("peer disconnected")
+
 func errResp(code errCode, format string, v ...interface{}) error {
 	return fmt.Errorf("%v - %v", code, fmt.Sprintf(format, v...))
 }
 
+// errDecodeMsg wraps a message decoding failure with the message type and the
+// protocol version negotiated with the peer, so malformed RLP can be traced back
+// to the message and peer implementation that produced it.
+func errDecodeMsg(p *peer, msg p2p.Msg, err error) error {
+	return errResp(ErrDecode, "%v %s from eth/%d peer: %v", msg, msgCodeName(msg.Code), p.version, err)
+}
+
 type ProtocolManager struct {
 	networkID uint64
 
@@ -357,98 +373,42 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// Decode the complex header query
 		var query getBlockHeadersData
 		if err := msg.Decode(&query); err != nil {
-			return errResp(ErrDecode, "%v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
-		hashMode := query.Origin.Hash != (common.Hash{})
 		p.Log().Debug("[GetBlockHeadersMsg]Received a broadcast message", "origin.Number", query.Origin.Number,
 			"origin.Hash", query.Origin.Hash, "skip", query.Skip, "amount", query.Amount,
 			"reverse", query.Reverse, "number", pm.blockchain.CurrentBlock().Number(),
 			"hash", pm.blockchain.CurrentBlock().Hash())
-		first := true
-		maxNonCanonical := uint64(100)
-
-		// Gather headers until the fetch or network limits is reached
-		var (
-			bytes   common.StorageSize
-			headers []*types.Header
-			unknown bool
-		)
-		for !unknown && len(headers) < int(query.Amount) && bytes < softResponseLimit && len(headers) < downloader.MaxHeaderFetch {
-			// Retrieve the next header satisfying the query
-			var origin *types.Header
-			if hashMode {
-				if first {
-					first = false
-					origin = pm.blockchain.GetHeaderByHash(query.Origin.Hash)
-					if origin != nil {
-						query.Origin.Number = origin.Number.Uint64()
-					}
-				} else {
-					origin = pm.blockchain.GetHeader(query.Origin.Hash, query.Origin.Number)
-				}
-			} else {
-				origin = pm.blockchain.GetHeaderByNumber(query.Origin.Number)
-			}
-			if origin == nil {
-				break
-			}
-			headers = append(headers, origin)
-			bytes += estHeaderRlpSize
-
-			// Advance to the next header of the query
-			switch {
-			case hashMode && query.Reverse:
-				// Hash based traversal towards the genesis block
-				ancestor := query.Skip + 1
-				if ancestor == 0 {
-					unknown = true
-				} else {
-					query.Origin.Hash, query.Origin.Number = pm.blockchain.GetAncestor(query.Origin.Hash, query.Origin.Number, ancestor, &maxNonCanonical)
-					unknown = (query.Origin.Hash == common.Hash{})
-				}
-			case hashMode && !query.Reverse:
-				// Hash based traversal towards the leaf block
-				var (
-					current = origin.Number.Uint64()
-					next    = current + query.Skip + 1
-				)
-				if next <= current {
-					infos, _ := json.MarshalIndent(p.Peer.Info(), "", "  ")
-					p.Log().Warn("GetBlockHeaders skip overflow attack", "current", current, "skip", query.Skip, "next", next, "attacker", infos)
-					unknown = true
-				} else {
-					if header := pm.blockchain.GetHeaderByNumber(next); header != nil {
-						nextHash := header.Hash()
-						expOldHash, _ := pm.blockchain.GetAncestor(nextHash, next, query.Skip+1, &maxNonCanonical)
-						if expOldHash == query.Origin.Hash {
-							query.Origin.Hash, query.Origin.Number = nextHash, next
-						} else {
-							unknown = true
-						}
-					} else {
-						unknown = true
-					}
-				}
-			case query.Reverse:
-				// Number based traversal towards the genesis block
-				if query.Origin.Number >= query.Skip+1 {
-					query.Origin.Number -= query.Skip + 1
-				} else {
-					unknown = true
-				}
-
-			case !query.Reverse:
-				// Number based traversal towards the leaf block
-				query.Origin.Number += query.Skip + 1
-			}
+		// Normalize the query so that requests yielding the same response share a
+		// cache entry, then serve repeated requests of the peer from its cache
+		// while the head is unchanged.
+		if limit := uint64(downloader.MaxHeaderFetch); query.Amount > limit {
+			query.Amount = limit
 		}
+		if query.Origin.Hash != (common.Hash{}) {
+			// The number of a hash origin is overwritten by the traversal
+			query.Origin.Number = 0
+		}
+		head := pm.blockchain.CurrentHeader().CacheHash()
+		if cached, ok := p.headerResponses.Get(query); ok && cached.(*headerResponse).head == head {
+			headers := cached.(*headerResponse).headers
+			p.Log().Debug("Send cached headers", "headers", len(headers))
+			return p.SendBlockHeaders(headers)
+		}
+		// Skip overflow queries are never cached, so that each repetition of the
+		// attack is still traversed and logged.
+		headers, overflow := pm.answerGetBlockHeadersQuery(query, p)
+		if !overflow {
+			p.headerResponses.Add(query, &headerResponse{head: head, headers: headers})
+		}
+
 		p.Log().Debug("Send headers", "headers", len(headers))
 		return p.SendBlockHeaders(headers)
 	case p.version >= eth63 && msg.Code == GetOriginAndPivotMsg:
 		p.Log().Info("[GetOriginAndPivotMsg]Received a broadcast message")
 		var query uint64
 		if err := msg.Decode(&query); err != nil {
-			return errResp(ErrDecode, "%v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		oHead := pm.blockchain.GetHeaderByNumber(query)
 		pivot, err := snapshotdb.Instance().BaseNum()
@@ -472,7 +432,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		p.Log().Debug("[OriginAndPivotMsg]Received a broadcast message")
 		var data []*types.Header
 		if err := msg.Decode(&data); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		// Deliver all to the downloader
 		if err := pm.downloader.DeliverOriginAndPivot(p.id, data); err != nil {
@@ -483,57 +443,12 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		p.Log().Info("[GetDPOSStorageMsg]Received a broadcast message")
 		var query []interface{}
 		if err := msg.Decode(&query); err != nil {
-			return errResp(ErrDecode, "%v: %v", msg, err)
-		}
-		f := func(num *big.Int, iter iterator.Iterator) error {
-			var psInfo DPOSInfo
-			if num == nil {
-				return errors.New("num should not be nil")
-			}
-			psInfo.Pivot = pm.blockchain.GetHeaderByNumber(num.Uint64())
-			psInfo.Latest = pm.blockchain.CurrentHeader()
-			if err := p.SendDPOSInfo(psInfo); err != nil {
-				p.Log().Error("[GetDPOSStorageMsg]send last dpos meassage fail", "error", err)
-				return err
-			}
-			var (
-				byteSize int
-				ps       DPOSStorage
-				count    int
-			)
-			ps.KVs = make([]downloader.DPOSStorageKV, 0)
-			for iter.Next() {
-				if bytes.Equal(iter.Key(), []byte(snapshotdb.CurrentHighestBlock)) || bytes.Equal(iter.Key(), []byte(snapshotdb.CurrentBaseNum)) || bytes.HasPrefix(iter.Key(), []byte(snapshotdb.WalKeyPrefix)) {
-					continue
-				}
-				byteSize = byteSize + len(iter.Key()) + len(iter.Value())
-				if count >= downloader.DPOSStorageKVSizeFetch || byteSize > softResponseLimit {
-					if err := p.SendDPOSStorage(ps); err != nil {
-						p.Log().Error("[GetDPOSStorageMsg]send dpos message fail", "error", err, "kvnum", ps.KVNum)
-						return err
-					}
-					count = 0
-					ps.KVs = make([]downloader.DPOSStorageKV, 0)
-					byteSize = 0
-				}
-				k, v := make([]byte, len(iter.Key())), make([]byte, len(iter.Value()))
-				copy(k, iter.Key())
-				copy(v, iter.Value())
-				ps.KVs = append(ps.KVs, [2][]byte{
-					k, v,
-				})
-				ps.KVNum++
-				count++
-			}
-			ps.Last = true
-			if err := p.SendDPOSStorage(ps); err != nil {
-				p.Log().Error("[GetDPOSStorageMsg]send last dpos message fail", "error", err)
-				return err
-			}
-			return nil
+			return errDecodeMsg(p, msg, err)
 		}
 		go func() {
-			if err := snapshotdb.Instance().WalkBaseDB(nil, f); err != nil {
+			if err := snapshotdb.Instance().WalkBaseDB(nil, pm.dposStorageWalker(p)); err == errPeerDisconnected {
+				p.Log().Debug("[GetDPOSStorageMsg]peer disconnected, dpos storage walk aborted")
+			} else if err != nil {
 				p.Log().Error("[GetDPOSStorageMsg]send  dpos storage fail", "error", err)
 			}
 		}()
@@ -542,7 +457,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		p.Log().Debug("Received a broadcast message[DposStorageMsg]")
 		var data DPOSStorage
 		if err := msg.Decode(&data); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		// Deliver all to the downloader
 		if err := pm.downloader.DeliverDposStorage(p.id, data.KVs, data.Last, data.KVNum); err != nil {
@@ -552,7 +467,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		p.Log().Debug("Received a broadcast message[DPOSInfoMsg]")
 		var data DPOSInfo
 		if err := msg.Decode(&data); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		// Deliver all to the downloader
 		if err := pm.downloader.DeliverDposInfo(p.id, data.Latest, data.Pivot); err != nil {
@@ -563,7 +478,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// A batch of headers arrived to one of our previous requests
 		var headers []*types.Header
 		if err := msg.Decode(&headers); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 
 		p.Log().Debug("Receive BlockHeadersMsg, before filter", "headers", len(headers))
@@ -599,7 +514,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			if err := msgStream.Decode(&hash); err == rlp.EOL {
 				break
 			} else if err != nil {
-				return errResp(ErrDecode, "msg %v: %v", msg, err)
+				return errDecodeMsg(p, msg, err)
 			}
 			// Retrieve the requested block body, stopping if enough was found
 			log.Debug(fmt.Sprintf("Send block body peer:%s,hash:%v", p.id, hash.Hex()))
@@ -619,7 +534,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// A batch of block bodies arrived to one of our previous requests
 		var request blockBodiesData
 		if err := msg.Decode(&request); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		// Deliver them all to the downloader for queuing
 		transactions := make([][]*types.Transaction, len(request))
@@ -661,7 +576,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			if err := msgStream.Decode(&hash); err == rlp.EOL {
 				break
 			} else if err != nil {
-				return errResp(ErrDecode, "msg %v: %v", msg, err)
+				return errDecodeMsg(p, msg, err)
 			}
 			// Retrieve the requested state entry, stopping if enough was found
 			// todo now the code and trienode is mixed in the protocol level,
@@ -689,7 +604,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// A batch of node state data arrived to one of our previous requests
 		var data [][]byte
 		if err := msg.Decode(&data); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		// Deliver all to the downloader
 		if err := pm.downloader.DeliverNodeData(p.id, data); err != nil {
@@ -713,7 +628,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 			if err := msgStream.Decode(&hash); err == rlp.EOL {
 				break
 			} else if err != nil {
-				return errResp(ErrDecode, "msg %v: %v", msg, err)
+				return errDecodeMsg(p, msg, err)
 			}
 			// Retrieve the requested block's receipts, skipping if unknown to us
 			results := pm.blockchain.GetReceiptsByHash(hash)
@@ -736,7 +651,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// A batch of receipts arrived to one of our previous requests
 		var receipts [][]*types.Receipt
 		if err := msg.Decode(&receipts); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		// Deliver all to the downloader
 		if err := pm.downloader.DeliverReceipts(p.id, receipts); err != nil {
@@ -746,8 +661,12 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 	case msg.Code == NewBlockHashesMsg:
 		var announces newBlockHashesData
 		if err := msg.Decode(&announces); err != nil {
-			return errResp(ErrDecode, "%v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
+		}
+		if len(announces) > maxBlockHashAnnounces {
+			return errResp(ErrMsgTooLarge, "%d block announcements > %d", len(announces), maxBlockHashAnnounces)
 		}
+		announces = dedupBlockAnnounces(announces)
 
 		// Mark the hashes as present at the remote node
 		for _, block := range announces {
@@ -770,7 +689,10 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// Retrieve and decode the propagated block
 		var request newBlockData
 		if err := msg.Decode(&request); err != nil {
-			return errResp(ErrDecode, "%v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
+		}
+		if err := pm.checkBlockBounds(request.Block); err != nil {
+			return err
 		}
 		request.Block.ReceivedAt = msg.ReceivedAt
 		request.Block.ReceivedFrom = p
@@ -806,12 +728,12 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// Transactions can be processed, parse all of them and deliver to the pool
 		var txs []*types.Transaction
 		if err := msg.Decode(&txs); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		for i, tx := range txs {
 			// Validate and mark the remote transaction
 			if tx == nil {
-				return errResp(ErrDecode, "transaction %d is nil", i)
+				return errDecodeMsg(p, msg, fmt.Errorf("transaction %d is nil", i))
 			}
 			p.MarkTransaction(tx.Hash())
 		}
@@ -826,7 +748,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 	case p.version >= eth65 && msg.Code == NewPooledTransactionHashesMsg:
 		ann := new(NewPooledTransactionHashesPacket)
 		if err := msg.Decode(ann); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		// Schedule all the unknown hashes for retrieval
 		for _, hash := range *ann {
@@ -838,7 +760,7 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// Decode the pooled transactions retrieval message
 		var query GetPooledTransactionsPacket
 		if err := msg.Decode(&query); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		log.Trace("Handler Receive GetPooledTransactions", "peer", p.id, "hashes", len(query))
 		hashes, txs := pm.answerGetPooledTransactions(query, p)
@@ -856,12 +778,12 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		// Transactions can be processed, parse all of them and deliver to the pool
 		var txs PooledTransactionsPacket
 		if err := msg.Decode(&txs); err != nil {
-			return errResp(ErrDecode, "msg %v: %v", msg, err)
+			return errDecodeMsg(p, msg, err)
 		}
 		for i, tx := range txs {
 			// Validate and mark the remote transaction
 			if tx == nil {
-				return errResp(ErrDecode, "transaction %d is nil", i)
+				return errDecodeMsg(p, msg, fmt.Errorf("transaction %d is nil", i))
 			}
 			p.MarkTransaction(tx.Hash())
 		}
@@ -874,6 +796,221 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 	return nil
 }
 
+// answerGetBlockHeadersQuery collects the headers requested by the given query,
+// until the fetch or network limits are reached. It also reports whether the
+// traversal was cut short by a skip overflow, which marks a malicious query.
+func (pm *ProtocolManager) answerGetBlockHeadersQuery(query getBlockHeadersData, p *peer) ([]*types.Header, bool) {
+	hashMode := query.Origin.Hash != (common.Hash{})
+	first := true
+	maxNonCanonical := uint64(100)
+
+	// Gather headers until the fetch or network limits is reached
+	var (
+		bytes    common.StorageSize
+		headers  []*types.Header
+		unknown  bool
+		overflow bool
+	)
+	for !unknown && len(headers) < int(query.Amount) && bytes < softResponseLimit && len(headers) < downloader.MaxHeaderFetch {
+		// Retrieve the next header satisfying the query
+		var origin *types.Header
+		if hashMode {
+			if first {
+				first = false
+				origin = pm.blockchain.GetHeaderByHash(query.Origin.Hash)
+				if origin != nil {
+					query.Origin.Number = origin.Number.Uint64()
+				}
+			} else {
+				origin = pm.blockchain.GetHeader(query.Origin.Hash, query.Origin.Number)
+			}
+		} else {
+			origin = pm.blockchain.GetHeaderByNumber(query.Origin.Number)
+		}
+		if origin == nil {
+			break
+		}
+		headers = append(headers, origin)
+		bytes += estHeaderRlpSize
+
+		// Advance to the next header of the query
+		switch {
+		case hashMode && query.Reverse:
+			// Hash based traversal towards the genesis block
+			ancestor := query.Skip + 1
+			if ancestor == 0 {
+				unknown = true
+			} else {
+				query.Origin.Hash, query.Origin.Number = pm.blockchain.GetAncestor(query.Origin.Hash, query.Origin.Number, ancestor, &maxNonCanonical)
+				unknown = (query.Origin.Hash == common.Hash{})
+			}
+		case hashMode && !query.Reverse:
+			// Hash based traversal towards the leaf block
+			var (
+				current = origin.Number.Uint64()
+				next    = current + query.Skip + 1
+			)
+			if next <= current {
+				infos, _ := json.MarshalIndent(p.Peer.Info(), "", "  ")
+				p.Log().Warn("GetBlockHeaders skip overflow attack", "current", current, "skip", query.Skip, "next", next, "attacker", infos)
+				unknown, overflow = true, true
+			} else {
+				if header := pm.blockchain.GetHeaderByNumber(next); header != nil {
+					nextHash := header.Hash()
+					expOldHash, _ := pm.blockchain.GetAncestor(nextHash, next, query.Skip+1, &maxNonCanonical)
+					if expOldHash == query.Origin.Hash {
+						query.Origin.Hash, query.Origin.Number = nextHash, next
+					} else {
+						unknown = true
+					}
+				} else {
+					unknown = true
+				}
+			}
+		case query.Reverse:
+			// Number based traversal towards the genesis block
+			if ancestor := query.Skip + 1; ancestor == 0 {
+				unknown = true
+			} else if query.Origin.Number >= ancestor {
+				query.Origin.Number -= ancestor
+			} else {
+				unknown = true
+			}
+
+		case !query.Reverse:
+			// Number based traversal towards the leaf block
+			var (
+				current = query.Origin.Number
+				next    = current + query.Skip + 1
+			)
+			if next <= current {
+				infos, _ := json.MarshalIndent(p.Peer.Info(), "", "  ")
+				p.Log().Warn("GetBlockHeaders skip overflow attack", "current", current, "skip", query.Skip, "next", next, "attacker", infos)
+				unknown, overflow = true, true
+			} else {
+				query.Origin.Number = next
+			}
+		}
+	}
+	return headers, overflow
+}
+
+// dposStorageWalker returns the snapshotdb walk callback streaming the DPOS
+// storage to the given peer. The walk is aborted as soon as the peer goes away
+// instead of running the full base DB for nobody.
+func (pm *ProtocolManager) dposStorageWalker(p *peer) func(num *big.Int, iter iterator.Iterator) error {
+	return func(num *big.Int, iter iterator.Iterator) error {
+		var psInfo DPOSInfo
+		if num == nil {
+			return errors.New("num should not be nil")
+		}
+		psInfo.Pivot = pm.blockchain.GetHeaderByNumber(num.Uint64())
+		psInfo.Latest = pm.blockchain.CurrentHeader()
+		if err := p.SendDPOSInfo(psInfo); err != nil {
+			p.Log().Error("[GetDPOSStorageMsg]send last dpos meassage fail", "error", err)
+			return err
+		}
+		var (
+			byteSize int
+			ps       DPOSStorage
+			count    int
+		)
+		ps.KVs = make([]downloader.DPOSStorageKV, 0)
+		for iter.Next() {
+			if p.closed() {
+				return errPeerDisconnected
+			}
+			if bytes.Equal(iter.Key(), []byte(snapshotdb.CurrentHighestBlock)) || bytes.Equal(iter.Key(), []byte(snapshotdb.CurrentBaseNum)) || bytes.HasPrefix(iter.Key(), []byte(snapshotdb.WalKeyPrefix)) {
+				continue
+			}
+			byteSize = byteSize + len(iter.Key()) + len(iter.Value())
+			if count >= downloader.DPOSStorageKVSizeFetch || byteSize > softResponseLimit {
+				if err := p.SendDPOSStorage(ps); err != nil {
+					p.Log().Error("[GetDPOSStorageMsg]send dpos message fail", "error", err, "kvnum", ps.KVNum)
+					return err
+				}
+				count = 0
+				ps.KVs = make([]downloader.DPOSStorageKV, 0)
+				byteSize = 0
+			}
+			k, v := make([]byte, len(iter.Key())), make([]byte, len(iter.Value()))
+			copy(k, iter.Key())
+			copy(v, iter.Value())
+			ps.KVs = append(ps.KVs, [2][]byte{
+				k, v,
+			})
+			ps.KVNum++
+			count++
+		}
+		if p.closed() {
+			return errPeerDisconnected
+		}
+		ps.Last = true
+		if err := p.SendDPOSStorage(ps); err != nil {
+			p.Log().Error("[GetDPOSStorageMsg]send last dpos message fail", "error", err)
+			return err
+		}
+		return nil
+	}
+}
+
+// dedupBlockAnnounces filters out repeated hashes from a block announcement,
+// keeping the first occurrence of each, so that a peer cannot amplify the work
+// done per announcement by repeating the same block.
+func dedupBlockAnnounces(announces newBlockHashesData) newBlockHashesData {
+	seen := make(map[common.Hash]struct{}, len(announces))
+	unique := make(newBlockHashesData, 0, len(announces))
+	for _, block := range announces {
+		if _, ok := seen[block.Hash]; ok {
+			continue
+		}
+		seen[block.Hash] = struct{}{}
+		unique = append(unique, block)
+	}
+	return unique
+}
+
+// checkBlockBounds performs cheap sanity checks on a propagated block before it
+// is handed over for import, so that a peer cannot force us into recomputing the
+// transaction root of a bloated block that could never be valid.
+func (pm *ProtocolManager) checkBlockBounds(block *types.Block) error {
+	// The gas limit is chosen by the sender, so bound it before deriving any other
+	// limit from it. Every block moves the gas limit of its parent towards the
+	// governed ceiling, which never exceeds MaxGasCeil, so no block of the chain
+	// may carry more than the larger of that and the gas limit of the genesis.
+	if limit := pm.gasLimitCeil(); block.GasLimit() > limit {
+		return errResp(ErrOversizedBlock, "gas limit %d > %d allowed", block.GasLimit(), limit)
+	}
+	if block.GasUsed() > block.GasLimit() {
+		return errResp(ErrOversizedBlock, "gas used %d > gas limit %d", block.GasUsed(), block.GasLimit())
+	}
+	// Every transaction pays at least the intrinsic gas, which caps how many of
+	// them can fit into a block with the announced gas limit.
+	txs := uint64(len(block.Transactions()))
+	if txs > block.GasLimit()/params.TxGas {
+		return errResp(ErrOversizedBlock, "%d txs > %d allowed by gas limit %d", txs, block.GasLimit()/params.TxGas, block.GasLimit())
+	}
+	// On top of that, every byte of transaction data is paid for at no less than
+	// the cheapest per byte price, which caps the size of the transactions.
+	var size uint64
+	for _, tx := range block.Transactions() {
+		size += uint64(len(tx.Data()))
+	}
+	if allowed := (block.GasLimit() - txs*params.TxGas) / params.TxDataZeroWasmDeployGas; size > allowed {
+		return errResp(ErrOversizedBlock, "%d bytes of tx data > %d allowed by gas limit %d", size, allowed, block.GasLimit())
+	}
+	return nil
+}
+
+// gasLimitCeil returns the highest gas limit any block of the local chain may
+// carry, which is MaxGasCeil unless the genesis block started out above it.
+func (pm *ProtocolManager) gasLimitCeil() uint64 {
+	if limit := pm.blockchain.Genesis().GasLimit(); limit > params.MaxGasCeil {
+		return limit
+	}
+	return params.MaxGasCeil
+}
+
 // BroadcastBlock will either propagate a block to a subset of its peers, or
 // will only announce its availability (depending what's requested).
 func (pm *ProtocolManager) BroadcastBlock(block *types.Block, propagate bool) {
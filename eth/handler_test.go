@@ -21,7 +21,9 @@ import (
 	"math"
 	"math/big"
 	"math/rand"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bubblenet/bubble/core/rawdb"
 
@@ -33,6 +35,7 @@ import (
 	"github.com/bubblenet/bubble/crypto"
 	"github.com/bubblenet/bubble/eth/downloader"
 	"github.com/bubblenet/bubble/p2p"
+	"github.com/bubblenet/bubble/p2p/discover"
 	"github.com/bubblenet/bubble/params"
 )
 
@@ -190,6 +193,24 @@ func testGetBlockHeaders(t *testing.T, protocol int) {
 				pm.blockchain.GetBlockByNumber(1).Hash(),
 			},
 		},
+		// Check that number based skipping overflow does not wrap back into the chain,
+		// nor repeat the origin in either direction
+		{
+			&getBlockHeadersData{Origin: hashOrNumber{Number: 3}, Amount: 2, Reverse: false, Skip: math.MaxUint64 - 1},
+			[]common.Hash{
+				pm.blockchain.GetBlockByNumber(3).Hash(),
+			},
+		}, {
+			&getBlockHeadersData{Origin: hashOrNumber{Number: 1}, Amount: 2, Reverse: false, Skip: math.MaxUint64},
+			[]common.Hash{
+				pm.blockchain.GetBlockByNumber(1).Hash(),
+			},
+		}, {
+			&getBlockHeadersData{Origin: hashOrNumber{Number: 3}, Amount: 2, Reverse: true, Skip: math.MaxUint64},
+			[]common.Hash{
+				pm.blockchain.GetBlockByNumber(3).Hash(),
+			},
+		},
 		// Check that non existing headers aren't returned
 		{
 			&getBlockHeadersData{Origin: hashOrNumber{Hash: unknown}, Amount: 1},
@@ -225,6 +246,89 @@ func testGetBlockHeaders(t *testing.T, protocol int) {
 	}
 }
 
+// Tests that header query responses are served from the cache while the chain
+// head is unchanged, and recomputed once the head moves on.
+func TestGetBlockHeadersCache(t *testing.T) {
+	pm, db := newTestProtocolManagerMust(t, downloader.FullSync, 16, nil, nil)
+	peer, _ := newTestPeer("peer", 63, pm, true)
+	defer pm.Stop()
+	defer peer.close()
+
+	query := getBlockHeadersData{Origin: hashOrNumber{Number: 14}, Amount: 4}
+	headers := []*types.Header{
+		pm.blockchain.GetHeaderByNumber(14),
+		pm.blockchain.GetHeaderByNumber(15),
+		pm.blockchain.GetHeaderByNumber(16),
+	}
+	p2p.Send(peer.app, GetBlockHeadersMsg, &query)
+	if err := p2p.ExpectMsg(peer.app, BlockHeadersMsg, headers); err != nil {
+		t.Fatalf("headers mismatch: %v", err)
+	}
+	cached, ok := peer.headerResponses.Get(query)
+	if !ok {
+		t.Fatalf("header response not cached")
+	}
+	// Swap in a marker response to detect whether the cache is hit
+	head := cached.(*headerResponse).head
+	marker := []*types.Header{pm.blockchain.GetHeaderByNumber(10)}
+	peer.headerResponses.Add(query, &headerResponse{head: head, headers: marker})
+
+	p2p.Send(peer.app, GetBlockHeadersMsg, &query)
+	if err := p2p.ExpectMsg(peer.app, BlockHeadersMsg, marker); err != nil {
+		t.Errorf("cached headers not served: %v", err)
+	}
+	// Other peers must not be served from the cache of this one
+	other, _ := newTestPeer("other", 63, pm, true)
+	defer other.close()
+
+	p2p.Send(other.app, GetBlockHeadersMsg, &query)
+	if err := p2p.ExpectMsg(other.app, BlockHeadersMsg, headers); err != nil {
+		t.Errorf("headers cached for another peer served: %v", err)
+	}
+	// Extend the chain, responses assembled against the previous head must not be served
+	blocks, receipts := core.GenerateChain(params.TestChainConfig, pm.blockchain.CurrentBlock(), pm.blockchain.Engine(), db, 1, nil)
+	statedb, err := pm.blockchain.StateAt(blocks[0].Root())
+	if err != nil {
+		t.Fatalf("failed to retrieve state: %v", err)
+	}
+	if _, err := pm.blockchain.WriteBlockWithState(blocks[0], receipts[0], nil, statedb, false); err != nil {
+		t.Fatalf("failed to extend chain: %v", err)
+	}
+	if pm.blockchain.CurrentHeader().CacheHash() == head {
+		t.Fatalf("chain head not moved")
+	}
+	headers = append(headers, blocks[0].Header())
+
+	p2p.Send(peer.app, GetBlockHeadersMsg, &query)
+	if err := p2p.ExpectMsg(peer.app, BlockHeadersMsg, headers); err != nil {
+		t.Errorf("stale cached headers served: %v", err)
+	}
+	// Amounts above the fetch limit must share the entry of the clamped query
+	peer.headerResponses.Purge()
+	for _, amount := range []uint64{uint64(downloader.MaxHeaderFetch) + 1, math.MaxUint64} {
+		oversized := getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: amount}
+		p2p.Send(peer.app, GetBlockHeadersMsg, &oversized)
+		if err := p2p.ExpectMsg(peer.app, BlockHeadersMsg, nil); err != nil {
+			t.Fatalf("amount %d: %v", amount, err)
+		}
+	}
+	if n := peer.headerResponses.Len(); n != 1 {
+		t.Errorf("cached entries mismatch: have %d, want 1", n)
+	}
+	if !peer.headerResponses.Contains(getBlockHeadersData{Origin: hashOrNumber{Number: 0}, Amount: uint64(downloader.MaxHeaderFetch)}) {
+		t.Errorf("oversized query not cached under the clamped amount")
+	}
+	// Skip overflow queries must not be cached
+	overflow := getBlockHeadersData{Origin: hashOrNumber{Number: 3}, Amount: 2, Skip: math.MaxUint64 - 1}
+	p2p.Send(peer.app, GetBlockHeadersMsg, &overflow)
+	if err := p2p.ExpectMsg(peer.app, BlockHeadersMsg, []*types.Header{pm.blockchain.GetHeaderByNumber(3)}); err != nil {
+		t.Fatalf("overflow headers mismatch: %v", err)
+	}
+	if peer.headerResponses.Contains(overflow) {
+		t.Errorf("skip overflow query response cached")
+	}
+}
+
 // Tests that block contents can be retrieved from a remote chain based on their hashes.
 func TestGetBlockBodies62(t *testing.T) { testGetBlockBodies(t, 62) }
 
@@ -400,6 +504,80 @@ func TestGetDPOSStorageMsg(t *testing.T) {
 	}
 }
 
+// Tests that the DPOS storage walk stops once the requesting peer disconnects
+// instead of walking the rest of the database.
+func TestGetDPOSStorageMsgPeerDisconnect(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, downloader.FullSync, downloader.MaxBlockFetch+15, nil, nil)
+	defer pm.Stop()
+	db, err := newSnapshotdb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Clear()
+
+	app, net := p2p.MsgPipe()
+	defer app.Close()
+	var id discover.NodeID
+	rand.Read(id[:])
+	p := pm.newPeer(63, p2p.NewPeer(id, "peer", nil), net, pm.txpool.Get)
+
+	errc := make(chan error, 1)
+	go func() { errc <- db.WalkBaseDB(nil, pm.dposStorageWalker(p)) }()
+
+	// Receive the DPOS info and the first storage batch, then disconnect mid-walk
+	if err := p2p.ExpectMsg(app, DPOSInfoMsg, nil); err != nil {
+		t.Fatalf("dpos info mismatch: %v", err)
+	}
+	msg, err := app.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read dpos storage: %v", err)
+	}
+	var batch DPOSStorage
+	if err := msg.Decode(&batch); err != nil {
+		t.Fatalf("failed to decode dpos storage: %v", err)
+	}
+	if batch.Last {
+		t.Fatalf("dpos storage fits a single batch, cannot disconnect mid-walk")
+	}
+	p.close()
+
+	// Drain the batch that may still be in flight, which must not be the last one
+	drained := make(chan []DPOSStorage, 1)
+	go func() {
+		var batches []DPOSStorage
+		for {
+			msg, err := app.ReadMsg()
+			if err != nil {
+				drained <- batches
+				return
+			}
+			var batch DPOSStorage
+			if err := msg.Decode(&batch); err != nil {
+				t.Errorf("failed to decode dpos storage: %v", err)
+			}
+			batches = append(batches, batch)
+		}
+	}()
+	select {
+	case err := <-errc:
+		if err != errPeerDisconnected {
+			t.Errorf("wrong walk error: got %v, want %v", err, errPeerDisconnected)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("dpos storage walk did not stop within 2 seconds")
+	}
+	app.Close()
+	batches := <-drained
+	if len(batches) > 1 {
+		t.Errorf("dpos storage batches sent after disconnect: have %d, want at most 1", len(batches))
+	}
+	for _, batch := range batches {
+		if batch.Last {
+			t.Errorf("last dpos storage batch sent after disconnect")
+		}
+	}
+}
+
 // Tests that the node state database can be retrieved based on hashes.
 func TestGetNodeData63(t *testing.T) { testGetNodeData(t, 63) }
 
@@ -548,3 +726,154 @@ func testGetReceipt(t *testing.T, protocol int) {
 		t.Errorf("receipts mismatch: %v", err)
 	}
 }
+
+// Tests that a propagated block carrying more transactions, or more transaction
+// data, than its gas limit can pay for is rejected and the sending peer dropped,
+// even if the block inflates its own gas limit to make room for them, while
+// blocks decaying from a genesis gas limit above the ceiling are accepted.
+func TestOversizedNewBlock(t *testing.T) {
+	highGasLimit := 10 * params.MaxGasCeil
+	tests := []struct {
+		genesisGasLimit uint64
+		gasLimit        uint64
+		datasize        int
+		wantError       error
+	}{
+		{
+			gasLimit:  params.TxGas,
+			wantError: errResp(ErrOversizedBlock, "2 txs > 1 allowed by gas limit %d", params.TxGas),
+		},
+		{
+			gasLimit:  2*params.TxGas + 1024,
+			datasize:  1024,
+			wantError: errResp(ErrOversizedBlock, "2048 bytes of tx data > 1024 allowed by gas limit %d", 2*params.TxGas+1024),
+		},
+		{
+			gasLimit:  math.MaxUint64,
+			wantError: errResp(ErrOversizedBlock, "gas limit %d > %d allowed", uint64(math.MaxUint64), params.MaxGasCeil),
+		},
+		{
+			gasLimit: params.MaxGasCeil,
+		},
+		{
+			genesisGasLimit: highGasLimit,
+			gasLimit:        highGasLimit - highGasLimit/params.GasLimitBoundDivisor + 1,
+		},
+		{
+			genesisGasLimit: highGasLimit,
+			gasLimit:        highGasLimit + 1,
+			wantError:       errResp(ErrOversizedBlock, "gas limit %d > %d allowed", highGasLimit+1, highGasLimit),
+		},
+	}
+	for i, tt := range tests {
+		pm, _, err := newTestProtocolManagerWithGasLimit(downloader.FullSync, 0, nil, nil, tt.genesisGasLimit)
+		if err != nil {
+			t.Fatalf("test %d: failed to create protocol manager: %v", i, err)
+		}
+		peer, errc := newTestPeer("peer", 63, pm, true)
+
+		header := &types.Header{
+			ParentHash: pm.blockchain.Genesis().Hash(),
+			Number:     big.NewInt(1),
+			GasLimit:   tt.gasLimit,
+			Extra:      make([]byte, 32),
+		}
+		txs := []*types.Transaction{newTestTransaction(testAccount, 0, tt.datasize), newTestTransaction(testAccount, 1, tt.datasize)}
+		block := types.NewBlockWithHeader(header).WithBody(txs, nil)
+
+		go p2p.Send(peer.app, NewBlockMsg, &newBlockData{Block: block})
+
+		if tt.wantError == nil {
+			// The block is marked as known by the peer once it passed the checks
+			for deadline := time.Now().Add(2 * time.Second); !peer.knownBlocks.Contains(block.Hash()); {
+				if time.Now().After(deadline) {
+					t.Errorf("test %d: block not accepted within 2 seconds", i)
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			select {
+			case err := <-errc:
+				t.Errorf("test %d: peer dropped: %v", i, err)
+			default:
+			}
+		} else {
+			select {
+			case err := <-errc:
+				if err == nil || err.Error() != tt.wantError.Error() {
+					t.Errorf("test %d: wrong error: got %v, want %v", i, err, tt.wantError)
+				}
+			case <-time.After(2 * time.Second):
+				t.Errorf("test %d: protocol did not shut down within 2 seconds", i)
+			}
+		}
+		peer.close()
+		pm.Stop()
+	}
+}
+
+// Tests that a malformed message is reported with the message code and the
+// protocol version of the peer that sent it.
+func TestDecodeErrorContext(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, downloader.FullSync, 0, nil, nil)
+	peer, errc := newTestPeer("peer", 63, pm, true)
+	defer pm.Stop()
+	defer peer.close()
+
+	go p2p.Send(peer.app, GetBlockHeadersMsg, "not a header query")
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("protocol returned nil error")
+		}
+		for _, want := range []string{"msg #3", "GetBlockHeadersMsg", "eth/63"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("decode error %q does not contain %q", err, want)
+			}
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("protocol did not shut down within 2 seconds")
+	}
+}
+
+// Tests that repeated hashes within a block announcement are only kept once.
+func TestDedupBlockAnnounces(t *testing.T) {
+	announces := make(newBlockHashesData, 50)
+	for i := range announces {
+		announces[i].Hash, announces[i].Number = common.Hash{byte(i % 3)}, uint64(i%3)
+	}
+	unique := dedupBlockAnnounces(announces)
+	if len(unique) != 3 {
+		t.Fatalf("unique announcement count mismatch: have %d, want 3", len(unique))
+	}
+	for i, block := range unique {
+		if block.Hash != (common.Hash{byte(i)}) || block.Number != uint64(i) {
+			t.Errorf("announcement %d mismatch: have %x/%d", i, block.Hash, block.Number)
+		}
+	}
+}
+
+// Tests that a peer announcing too many block hashes at once is dropped.
+func TestOversizedBlockAnnouncement(t *testing.T) {
+	pm, _ := newTestProtocolManagerMust(t, downloader.FullSync, 0, nil, nil)
+	peer, errc := newTestPeer("peer", 63, pm, true)
+	defer pm.Stop()
+	defer peer.close()
+
+	announces := make(newBlockHashesData, maxBlockHashAnnounces+1)
+	for i := range announces {
+		announces[i].Hash, announces[i].Number = common.Hash{1}, 1
+	}
+	go p2p.Send(peer.app, NewBlockHashesMsg, announces)
+
+	want := errResp(ErrMsgTooLarge, "%d block announcements > %d", maxBlockHashAnnounces+1, maxBlockHashAnnounces)
+	select {
+	case err := <-errc:
+		if err == nil || err.Error() != want.Error() {
+			t.Errorf("wrong error: got %v, want %v", err, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("protocol did not shut down within 2 seconds")
+	}
+}
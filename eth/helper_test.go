@@ -54,6 +54,13 @@ var (
 // with the given number of blocks already known, and potential notification
 // channels for different events.
 func newTestProtocolManager(mode downloader.SyncMode, blocks int, generator func(int, *core.BlockGen), newtx chan<- []*types.Transaction) (*ProtocolManager, ethdb.Database, error) {
+	return newTestProtocolManagerWithGasLimit(mode, blocks, generator, newtx, 0)
+}
+
+// newTestProtocolManagerWithGasLimit creates a new protocol manager for testing
+// purposes like newTestProtocolManager, with the gas limit of the genesis block
+// overridden if non-zero.
+func newTestProtocolManagerWithGasLimit(mode downloader.SyncMode, blocks int, generator func(int, *core.BlockGen), newtx chan<- []*types.Transaction, gasLimit uint64) (*ProtocolManager, ethdb.Database, error) {
 	xcom.GetEc(xcom.DefaultTestNet)
 	var (
 		evmux = new(event.TypeMux)
@@ -61,8 +68,9 @@ func newTestProtocolManager(mode downloader.SyncMode, blocks int, generator func
 		db     = rawdb.NewMemoryDatabase()
 		engine = consensus.NewFakerWithDataBase(db)
 		gspec  = &core.Genesis{
-			Config: params.TestChainConfig,
-			Alloc:  core.GenesisAlloc{testBank: {Balance: big.NewInt(1000000)}},
+			Config:   params.TestChainConfig,
+			Alloc:    core.GenesisAlloc{testBank: {Balance: big.NewInt(1000000)}},
+			GasLimit: gasLimit,
 		}
 		genesis = gspec.MustCommit(db)
 
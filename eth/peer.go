@@ -24,6 +24,8 @@ import (
 	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
+
 	"github.com/bubblenet/bubble/eth/downloader"
 
 	"github.com/bubblenet/bubble/common"
@@ -42,6 +44,8 @@ const (
 	maxKnownTxs    = 32768 // Maximum transactions hashes to keep in the known list (prevent DOS)
 	maxKnownBlocks = 1024  // Maximum block hashes to keep in the known list (prevent DOS)
 
+	maxHeaderResponses = 8 // Maximum header query responses to cache per peer
+
 	// maxQueuedTxs is the maximum number of transactions to queue up before dropping
 	// older broadcasts.
 	maxQueuedTxs = 4096
@@ -85,6 +89,13 @@ type PeerInfo struct {
 	Head    string   `json:"head"`    // SHA3 hash of the peer's best owned block
 }
 
+// headerResponse is a cached answer to a header query, only valid as long as the
+// chain head it was assembled against is still the current one.
+type headerResponse struct {
+	head    common.Hash
+	headers []*types.Header
+}
+
 // propEvent is a block propagation, waiting for its turn in the broadcast queue.
 type propEvent struct {
 	block *types.Block
@@ -112,10 +123,13 @@ type peer struct {
 	txAnnounce  chan []common.Hash                   // Channel used to queue transaction announcement requests
 	getPooledTx func(common.Hash) *types.Transaction // Callback used to retrieve transaction from txpool
 
+	headerResponses *lru.Cache // Header query responses recently served to the peer, keyed by query
+
 	term chan struct{} // Termination channel to stop the broadcaster
 }
 
 func newPeer(version int, p *p2p.Peer, rw p2p.MsgReadWriter, getPooledTx func(hash common.Hash) *types.Transaction) *peer {
+	headerResponses, _ := lru.New(maxHeaderResponses)
 	return &peer{
 		Peer:            p,
 		rw:              rw,
@@ -128,6 +142,7 @@ func newPeer(version int, p *p2p.Peer, rw p2p.MsgReadWriter, getPooledTx func(ha
 		txBroadcast:     make(chan []common.Hash),
 		txAnnounce:      make(chan []common.Hash),
 		getPooledTx:     getPooledTx,
+		headerResponses: headerResponses,
 		term:            make(chan struct{}),
 	}
 }
@@ -161,6 +176,16 @@ func (p *peer) close() {
 	close(p.term)
 }
 
+// closed reports whether the peer has been terminated.
+func (p *peer) closed() bool {
+	select {
+	case <-p.term:
+		return true
+	default:
+		return false
+	}
+}
+
 // Info gathers and returns a collection of metadata known about a peer.
 func (p *peer) Info() *PeerInfo {
 	hash, bn := p.Head()
@@ -532,7 +557,7 @@ func (p *peer) readStatus(network uint64, status *statusData, genesis common.Has
 	}
 	// Decode the handshake and make sure everything matches
 	if err := msg.Decode(&status); err != nil {
-		return errResp(ErrDecode, "msg %v: %v", msg, err)
+		return errDecodeMsg(p, msg, err)
 	}
 	if status.GenesisBlock != genesis {
 		return errResp(ErrGenesisBlockMismatch, "%x (!= %x)", status.GenesisBlock[:8], genesis[:8])
@@ -79,6 +79,43 @@ const (
 	PooledTransactionsMsg         = 0x18
 )
 
+// msgCodeNames maps the eth protocol message codes to their names, so that
+// logs and errors can identify a message without looking up the constants.
+var msgCodeNames = map[uint64]string{
+	StatusMsg:                     "StatusMsg",
+	NewBlockHashesMsg:             "NewBlockHashesMsg",
+	TransactionMsg:                "TransactionMsg",
+	GetBlockHeadersMsg:            "GetBlockHeadersMsg",
+	BlockHeadersMsg:               "BlockHeadersMsg",
+	GetBlockBodiesMsg:             "GetBlockBodiesMsg",
+	BlockBodiesMsg:                "BlockBodiesMsg",
+	NewBlockMsg:                   "NewBlockMsg",
+	PrepareBlockMsg:               "PrepareBlockMsg",
+	BlockSignatureMsg:             "BlockSignatureMsg",
+	PongMsg:                       "PongMsg",
+	GetNodeDataMsg:                "GetNodeDataMsg",
+	NodeDataMsg:                   "NodeDataMsg",
+	GetReceiptsMsg:                "GetReceiptsMsg",
+	ReceiptsMsg:                   "ReceiptsMsg",
+	GetDPOSStorageMsg:             "GetDPOSStorageMsg",
+	DPOSStorageMsg:                "DPOSStorageMsg",
+	GetOriginAndPivotMsg:          "GetOriginAndPivotMsg",
+	OriginAndPivotMsg:             "OriginAndPivotMsg",
+	DPOSInfoMsg:                   "DPOSInfoMsg",
+	NewPooledTransactionHashesMsg: "NewPooledTransactionHashesMsg",
+	GetPooledTransactionsMsg:      "GetPooledTransactionsMsg",
+	PooledTransactionsMsg:         "PooledTransactionsMsg",
+}
+
+// msgCodeName returns the name of the given message code, or a placeholder if
+// the code is not part of the protocol.
+func msgCodeName(code uint64) string {
+	if name, ok := msgCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("UnknownMsg(%#x)", code)
+}
+
 type errCode int
 
 const (
@@ -92,6 +129,7 @@ const (
 	ErrNoStatusMsg
 	ErrExtraStatusMsg
 	ErrSuspendedPeer
+	ErrOversizedBlock
 )
 
 func (e errCode) String() string {
@@ -109,6 +147,7 @@ var errorToString = map[int]string{
 	ErrNoStatusMsg:             "No status message",
 	ErrExtraStatusMsg:          "Extra status message",
 	ErrSuspendedPeer:           "Suspended peer",
+	ErrOversizedBlock:          "Oversized block",
 }
 
 // NewPooledTransactionHashesPacket represents a transaction announcement packet.